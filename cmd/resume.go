@@ -0,0 +1,75 @@
+// Copyright © 2020 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/hex"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/vulcanize/eth-pg-ipfs-state-snapshot/pkg/snapshot"
+)
+
+// resumeCmd restarts a crashed or killed snapshot of a single block, seeding the state
+// trie iterator at --from-path instead of the root. --from-path is typically the
+// nodePath most recently persisted to eth.snapshot_progress for this block.
+var resumeCmd = &cobra.Command{
+	Use:   "resume",
+	Short: "Resume a previously interrupted snapshot from a given trie path",
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = log.WithField("SubCommand", subCommand)
+		resumeCmdRun()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(resumeCmd)
+
+	resumeCmd.PersistentFlags().Uint64("height", 0, "block height to resume snapshotting")
+	resumeCmd.PersistentFlags().String("hash", "", "block hash to resume snapshotting")
+	resumeCmd.PersistentFlags().String("from-path", "", "hex-encoded trie path to resume the snapshot from")
+
+	viper.BindPFlag("resume.height", resumeCmd.PersistentFlags().Lookup("height"))
+	viper.BindPFlag("resume.hash", resumeCmd.PersistentFlags().Lookup("hash"))
+	viper.BindPFlag("resume.fromPath", resumeCmd.PersistentFlags().Lookup("from-path"))
+}
+
+func resumeCmdRun() {
+	service, err := snapshot.NewSnapshotService(snapshotConfig())
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	defer func() {
+		if err := service.Close(); err != nil {
+			logWithCommand.Fatal(err)
+		}
+	}()
+
+	height := viper.GetUint64("resume.height")
+	hash := common.HexToHash(viper.GetString("resume.hash"))
+	fromPath, err := hex.DecodeString(viper.GetString("resume.fromPath"))
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	logWithCommand.Infof("resuming snapshot of block %d (%s) from path %x", height, hash.Hex(), fromPath)
+	if err := service.ResumeSnapshot(height, hash, fromPath); err != nil {
+		logWithCommand.Fatal(err)
+	}
+}
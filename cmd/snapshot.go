@@ -0,0 +1,88 @@
+// Copyright © 2020 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/vulcanize/eth-pg-ipfs-state-snapshot/pkg/snapshot"
+)
+
+// snapshotCmd snapshots either a single block, given by --height/--hash, or a block
+// range, given by --range-start/--range-end, so that a full-archive snapshot can be
+// split across multiple machines and merged into the same Postgres schema
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Take a snapshot of state at a given block height or range of block heights",
+	Run: func(cmd *cobra.Command, args []string) {
+		subCommand = cmd.CalledAs()
+		logWithCommand = log.WithField("SubCommand", subCommand)
+		snapshotCmdRun()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(snapshotCmd)
+
+	snapshotCmd.PersistentFlags().Uint64("height", 0, "block height to snapshot")
+	snapshotCmd.PersistentFlags().String("hash", "", "block hash to snapshot")
+	snapshotCmd.PersistentFlags().Uint64("range-start", 0, "first block height to snapshot, inclusive")
+	snapshotCmd.PersistentFlags().Uint64("range-end", 0, "last block height to snapshot, inclusive")
+	snapshotCmd.PersistentFlags().Int("workers", 0, "size of the worker pool used to traverse subtries concurrently (0 or 1 for single-threaded)")
+	snapshotCmd.PersistentFlags().String("checkpoint-path", "", "file used to track completed subtries so a parallel snapshot can resume")
+	snapshotCmd.PersistentFlags().Bool("emit-ranges", false, "additionally emit snap-protocol-style account/storage ranges with boundary proofs")
+	snapshotCmd.PersistentFlags().Int("range-size", 0, "number of leaves per emitted range when --emit-ranges is set (defaults to 4096)")
+
+	viper.BindPFlag("snapshot.height", snapshotCmd.PersistentFlags().Lookup("height"))
+	viper.BindPFlag("snapshot.hash", snapshotCmd.PersistentFlags().Lookup("hash"))
+	viper.BindPFlag("snapshot.rangeStart", snapshotCmd.PersistentFlags().Lookup("range-start"))
+	viper.BindPFlag("snapshot.rangeEnd", snapshotCmd.PersistentFlags().Lookup("range-end"))
+	viper.BindPFlag("snapshot.workers", snapshotCmd.PersistentFlags().Lookup("workers"))
+	viper.BindPFlag("snapshot.checkpointPath", snapshotCmd.PersistentFlags().Lookup("checkpoint-path"))
+	viper.BindPFlag("snapshot.emitRanges", snapshotCmd.PersistentFlags().Lookup("emit-ranges"))
+	viper.BindPFlag("snapshot.rangeSize", snapshotCmd.PersistentFlags().Lookup("range-size"))
+}
+
+func snapshotCmdRun() {
+	service, err := snapshot.NewSnapshotService(snapshotConfig())
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	defer func() {
+		if err := service.Close(); err != nil {
+			logWithCommand.Fatal(err)
+		}
+	}()
+
+	if rangeEnd := viper.GetUint64("snapshot.rangeEnd"); rangeEnd > 0 {
+		rangeStart := viper.GetUint64("snapshot.rangeStart")
+		logWithCommand.Infof("snapshotting block range [%d, %d]", rangeStart, rangeEnd)
+		if err := service.CreateSnapshotInRange(rangeStart, rangeEnd); err != nil {
+			logWithCommand.Fatal(err)
+		}
+		return
+	}
+
+	height := viper.GetUint64("snapshot.height")
+	hash := common.HexToHash(viper.GetString("snapshot.hash"))
+	logWithCommand.Infof("snapshotting block %d (%s)", height, hash.Hex())
+	if err := service.CreateSnapshot(height, hash); err != nil {
+		logWithCommand.Fatal(err)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright © 2020 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/vulcanize/eth-pg-ipfs-state-snapshot/pkg/snapshot"
+	"github.com/vulcanize/ipfs-blockchain-watcher/pkg/eth/core"
+	"github.com/vulcanize/ipfs-blockchain-watcher/pkg/postgres"
+)
+
+// subCommand and logWithCommand are set at the top of each subcommand's Run func so
+// that log lines can be traced back to the subcommand that emitted them
+var (
+	subCommand     string
+	logWithCommand *log.Entry
+)
+
+// snapshotConfig builds a snapshot.Config from viper, shared by the snapshot and resume
+// subcommands
+func snapshotConfig() snapshot.Config {
+	return snapshot.Config{
+		DBConfig: postgres.Config{
+			Hostname:     viper.GetString("database.hostname"),
+			Port:         viper.GetInt("database.port"),
+			DatabaseName: viper.GetString("database.name"),
+			Username:     viper.GetString("database.user"),
+			Password:     viper.GetString("database.password"),
+		},
+		Node: core.Node{
+			ID:           viper.GetString("node.id"),
+			ClientName:   viper.GetString("node.clientName"),
+			GenesisBlock: viper.GetString("node.genesisBlock"),
+			NetworkID:    viper.GetString("node.networkID"),
+		},
+		LevelDBPath:    viper.GetString("leveldb.path"),
+		Workers:        viper.GetInt("snapshot.workers"),
+		CheckpointPath: viper.GetString("snapshot.checkpointPath"),
+		EmitRanges:     viper.GetBool("snapshot.emitRanges"),
+		RangeSize:      viper.GetInt("snapshot.rangeSize"),
+		Output:         viper.GetString("output.type"),
+		CarPath:        viper.GetString("output.carPath"),
+		CarSidecarPath: viper.GetString("output.carSidecarPath"),
+	}
+}
+
+func init() {
+	rootCmd.PersistentFlags().String("database-hostname", "localhost", "postgres database hostname")
+	rootCmd.PersistentFlags().Int("database-port", 5432, "postgres database port")
+	rootCmd.PersistentFlags().String("database-name", "vulcanize_public", "postgres database name")
+	rootCmd.PersistentFlags().String("database-user", "postgres", "postgres database user")
+	rootCmd.PersistentFlags().String("database-password", "", "postgres database password")
+	rootCmd.PersistentFlags().String("leveldb-path", "", "path to the leveldb chaindata directory")
+	rootCmd.PersistentFlags().String("output", snapshot.OutputPostgres, "output backend to publish the snapshot to (postgres or car)")
+	rootCmd.PersistentFlags().String("car-path", "", "CAR file to write the snapshot to, when --output=car")
+	rootCmd.PersistentFlags().String("car-sidecar-path", "", "JSON file to write the (block hash, path) -> CID sidecar index to, when --output=car")
+
+	viper.BindPFlag("database.hostname", rootCmd.PersistentFlags().Lookup("database-hostname"))
+	viper.BindPFlag("database.port", rootCmd.PersistentFlags().Lookup("database-port"))
+	viper.BindPFlag("database.name", rootCmd.PersistentFlags().Lookup("database-name"))
+	viper.BindPFlag("database.user", rootCmd.PersistentFlags().Lookup("database-user"))
+	viper.BindPFlag("database.password", rootCmd.PersistentFlags().Lookup("database-password"))
+	viper.BindPFlag("leveldb.path", rootCmd.PersistentFlags().Lookup("leveldb-path"))
+	viper.BindPFlag("output.type", rootCmd.PersistentFlags().Lookup("output"))
+	viper.BindPFlag("output.carPath", rootCmd.PersistentFlags().Lookup("car-path"))
+	viper.BindPFlag("output.carSidecarPath", rootCmd.PersistentFlags().Lookup("car-sidecar-path"))
+}
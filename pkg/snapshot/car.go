@@ -0,0 +1,153 @@
+// Copyright © 2020 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	carblockstore "github.com/ipld/go-car/v2/blockstore"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/vulcanize/ipfs-blockchain-watcher/pkg/eth"
+)
+
+// CarPublisher is a Publisher that writes the same IPLD blocks PostgresPublisher would
+// index in public.blocks into a single CARv2 file, for hosts that want a snapshot
+// artifact without standing up Postgres. Since a CAR file has no equivalent of
+// state_cids/storage_cids to look a node up by path, CarPublisher also maintains a JSON
+// sidecar mapping (block hash, path) to CID.
+type CarPublisher struct {
+	bs          *carblockstore.ReadWrite
+	sidecarPath string
+
+	mu         sync.Mutex
+	sidecar    map[string]string
+	nextID     int64
+	headerHash map[int64]common.Hash
+	stateHash  map[int64]common.Hash
+}
+
+// NewCarPublisher opens (creating if necessary) the CARv2 file at carPath for writing,
+// and prepares a JSON sidecar to be written to sidecarPath on Close
+func NewCarPublisher(carPath, sidecarPath string) (*CarPublisher, error) {
+	bs, err := carblockstore.OpenReadWrite(carPath, nil, carblockstore.UseWholeCIDs(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CAR file %s: %v", carPath, err)
+	}
+	return &CarPublisher{
+		bs:          bs,
+		sidecarPath: sidecarPath,
+		sidecar:     make(map[string]string),
+		headerHash:  make(map[int64]common.Hash),
+		stateHash:   make(map[int64]common.Hash),
+	}, nil
+}
+
+// PublishHeader writes the header's RLP as an eth-header IPLD block and assigns it a
+// local headerID so that state nodes published against it can be linked back to its hash
+func (p *CarPublisher) PublishHeader(header *types.Header) (int64, error) {
+	raw, err := rlp.EncodeToBytes(header)
+	if err != nil {
+		return 0, err
+	}
+	c := keccak256ToCid(MEthHeader, header.Hash().Bytes())
+	if err := p.putBlock(c, raw); err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextID++
+	headerID := p.nextID
+	p.headerHash[headerID] = header.Hash()
+	p.sidecar[sidecarKey(header.Hash(), nil)] = c.String()
+	return headerID, nil
+}
+
+// PublishStateNode writes a state trie node as an eth-state-trie IPLD block and assigns
+// it a local stateID so that storage nodes published against it can be linked back to
+// the same block hash
+func (p *CarPublisher) PublishStateNode(node *eth.StateNodeModel, headerID int64, raw []byte) (int64, error) {
+	c := keccak256ToCid(MEthStateTrie, crypto.Keccak256(raw))
+	if err := p.putBlock(c, raw); err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hash := p.headerHash[headerID]
+	p.nextID++
+	stateID := p.nextID
+	p.stateHash[stateID] = hash
+	p.sidecar[sidecarKey(hash, node.Path)] = c.String()
+	return stateID, nil
+}
+
+// PublishStorageNode writes a storage trie node as an eth-storage-trie IPLD block
+func (p *CarPublisher) PublishStorageNode(node *eth.StorageNodeModel, stateID int64, raw []byte) error {
+	c := keccak256ToCid(MEthStorageTrie, crypto.Keccak256(raw))
+	if err := p.putBlock(c, raw); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hash := p.stateHash[stateID]
+	p.sidecar[sidecarKey(hash, node.Path)] = c.String()
+	return nil
+}
+
+// PublishCode writes a contract's runtime bytecode as a raw-eth IPLD block
+func (p *CarPublisher) PublishCode(codeHash []byte, code []byte) error {
+	c := keccak256ToCid(RawBinary, codeHash)
+	return p.putBlock(c, code)
+}
+
+// Close finalizes the CARv2 file and writes the accumulated sidecar index to disk
+func (p *CarPublisher) Close() error {
+	if err := p.bs.Finalize(); err != nil {
+		return fmt.Errorf("failed to finalize CAR file: %v", err)
+	}
+	f, err := os.Create(p.sidecarPath)
+	if err != nil {
+		return fmt.Errorf("failed to create sidecar file %s: %v", p.sidecarPath, err)
+	}
+	defer f.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return json.NewEncoder(f).Encode(p.sidecar)
+}
+
+func (p *CarPublisher) putBlock(c cid.Cid, raw []byte) error {
+	b, err := blocks.NewBlockWithCid(raw, c)
+	if err != nil {
+		return err
+	}
+	return p.bs.Put(context.Background(), b)
+}
+
+// sidecarKey is the sidecar's lookup key for a block emitted while snapshotting blockHash,
+// found at the given trie path (nil/empty for the header block itself)
+func sidecarKey(blockHash common.Hash, path []byte) string {
+	return fmt.Sprintf("%s:%x", blockHash.Hex(), path)
+}
@@ -0,0 +1,101 @@
+// Copyright © 2020 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// checkpoint records, for a single (height, hash) snapshot, which top-level nibble
+// paths of the state trie have already been fully traversed and committed. It lets a
+// crashed or killed parallel snapshot be restarted without redoing completed subtries.
+type checkpoint struct {
+	Height    uint64      `json:"height"`
+	Hash      common.Hash `json:"hash"`
+	Completed []string    `json:"completed"`
+
+	path string
+	mu   sync.Mutex
+	done map[string]bool
+}
+
+// loadCheckpoint reads a checkpoint from path if it exists and matches height/hash,
+// otherwise it returns a fresh, empty checkpoint for this snapshot
+func loadCheckpoint(path string, height uint64, hash common.Hash) (*checkpoint, error) {
+	cp := &checkpoint{Height: height, Hash: hash, path: path, done: make(map[string]bool)}
+	if path == "" {
+		return cp, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var onDisk checkpoint
+	if err := json.NewDecoder(f).Decode(&onDisk); err != nil {
+		return nil, err
+	}
+	if onDisk.Height != height || onDisk.Hash != hash {
+		// stale checkpoint from a different snapshot; start fresh
+		return cp, nil
+	}
+	for _, prefix := range onDisk.Completed {
+		cp.done[prefix] = true
+	}
+	cp.Completed = onDisk.Completed
+	return cp, nil
+}
+
+// isDone reports whether the subtrie rooted at nibble path prefix has already completed
+func (c *checkpoint) isDone(prefix string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[prefix]
+}
+
+// markDone records prefix as completed and persists the checkpoint to disk
+func (c *checkpoint) markDone(prefix string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done[prefix] {
+		return nil
+	}
+	c.done[prefix] = true
+	c.Completed = append(c.Completed, prefix)
+	if c.path == "" {
+		return nil
+	}
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(c); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,57 @@
+// Copyright © 2020 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"github.com/vulcanize/ipfs-blockchain-watcher/pkg/eth/core"
+	"github.com/vulcanize/ipfs-blockchain-watcher/pkg/postgres"
+)
+
+// Output backends supported by Config.Output
+const (
+	OutputPostgres = "postgres"
+	OutputCar      = "car"
+)
+
+// Config holds the parameters needed to run a state snapshot
+type Config struct {
+	DBConfig    postgres.Config
+	Node        core.Node
+	LevelDBPath string
+
+	// Output selects the publishing backend: OutputPostgres (default) or OutputCar.
+	Output string
+	// CarPath is the CARv2 file snapshotted IPLD blocks are written to when Output is
+	// OutputCar
+	CarPath string
+	// CarSidecarPath is the JSON file mapping (block hash, path) to CID written alongside
+	// CarPath when Output is OutputCar
+	CarSidecarPath string
+
+	// Workers is the size of the worker pool used to traverse subtries concurrently.
+	// A value of 0 or 1 falls back to the single-threaded traversal.
+	Workers int
+	// CheckpointPath, if set, is where progress (completed top-level nibble paths) is
+	// recorded so that an interrupted parallel snapshot can be resumed
+	CheckpointPath string
+
+	// EmitRanges, if true, additionally emits snap-protocol-style account/storage ranges
+	// (contiguous chunks of leaves with boundary proofs) alongside the individual trie nodes
+	EmitRanges bool
+	// RangeSize is the number of leaves collected per emitted range when EmitRanges is set.
+	// Defaults to defaultRangeSize if unset.
+	RangeSize int
+}
@@ -0,0 +1,55 @@
+// Copyright © 2020 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// multicodec types pulled in from github.com/ipfs/go-cid/multicodec, mirrored here
+// so that this package does not need to pull in the full ipld-eth-indexer multicodec table
+const (
+	MEthHeader      = 0x90
+	MEthTx          = 0x93
+	MEthTxReceipt   = 0x95
+	MEthStateTrie   = 0x96
+	MEthStorageTrie = 0x98
+	RawBinary       = 0x55
+)
+
+// rawdataToCid takes the desired multiCodec type and the rawdata and calculates the cid for it
+func rawdataToCid(codec uint64, rawdata []byte, multiHashCode uint64) (cid.Cid, error) {
+	c, err := cid.Prefix{
+		Codec:    codec,
+		Version:  1,
+		MhType:   multiHashCode,
+		MhLength: -1,
+	}.Sum(rawdata)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	return c, nil
+}
+
+// keccak256ToCid takes a keccak256 hash and returns its cid based on the provided multicodec
+func keccak256ToCid(codec uint64, h []byte) cid.Cid {
+	buf, err := multihash.Encode(h, multihash.KECCAK_256)
+	if err != nil {
+		panic(err)
+	}
+	return cid.NewCidV1(codec, buf)
+}
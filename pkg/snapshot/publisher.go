@@ -0,0 +1,247 @@
+// Copyright © 2020 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"github.com/vulcanize/ipfs-blockchain-watcher/pkg/eth"
+	"github.com/vulcanize/ipfs-blockchain-watcher/pkg/postgres"
+)
+
+// Publisher is the output backend a Service writes published headers, state nodes,
+// storage nodes and code to. PostgresPublisher (below) is the original PG-IPFS backed
+// implementation; CarPublisher (car.go) writes the same IPLD blocks to a CARv2 file
+// instead, for use on hosts without Postgres connectivity.
+type Publisher interface {
+	PublishHeader(header *types.Header) (int64, error)
+	PublishStateNode(node *eth.StateNodeModel, headerID int64, raw []byte) (int64, error)
+	PublishStorageNode(node *eth.StorageNodeModel, stateID int64, raw []byte) error
+	PublishCode(codeHash []byte, code []byte) error
+	// Close releases any resources held by the publisher. CarPublisher uses this to
+	// finalize its CARv2 file and flush its sidecar index; PostgresPublisher is a no-op
+	// since every write already commits its own transaction.
+	Close() error
+}
+
+// PostgresPublisher writes headers, state nodes, storage nodes and code to the PG-IPFS
+// schema: raw IPLD blocks go to public.blocks, and the corresponding CIDs are
+// indexed in eth.header_cids, eth.state_cids and eth.storage_cids
+type PostgresPublisher struct {
+	db *postgres.DB
+}
+
+// NewPublisher returns a new Publisher
+func NewPublisher(db *postgres.DB) *PostgresPublisher {
+	return &PostgresPublisher{db: db}
+}
+
+// BeginTx opens a new transaction against the publisher's database, letting a caller
+// that wants to publish many nodes as a single atomic unit (e.g. one subtrie per worker)
+// drive the PublishXInTx variants directly and commit once at the end
+func (p *PostgresPublisher) BeginTx() (*sqlx.Tx, error) {
+	return p.db.Beginx()
+}
+
+// PublishHeader publishes a header IPLD block and indexes it in header_cids,
+// returning the new header_cids.id so that state nodes can be linked to it
+func (p *PostgresPublisher) PublishHeader(header *types.Header) (int64, error) {
+	tx, err := p.BeginTx()
+	if err != nil {
+		return 0, err
+	}
+	headerID, err := p.PublishHeaderInTx(tx, header)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return headerID, tx.Commit()
+}
+
+// PublishHeaderInTx is PublishHeader against a caller-supplied transaction
+func (p *PostgresPublisher) PublishHeaderInTx(tx *sqlx.Tx, header *types.Header) (int64, error) {
+	headerRLP, err := rlp.EncodeToBytes(header)
+	if err != nil {
+		return 0, err
+	}
+	c := keccak256ToCid(MEthHeader, header.Hash().Bytes())
+	mhKey := dshelp.CidToDsKey(c).String()
+	if err := publishIPLD(tx, mhKey, headerRLP); err != nil {
+		return 0, err
+	}
+	var headerID int64
+	err = tx.QueryRowx(`INSERT INTO eth.header_cids (block_number, block_hash, parent_hash, cid, state_root, tx_root,
+			receipt_root, uncle_root, bloom, timestamp, mh_key, times_validated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, 1)
+		ON CONFLICT (block_hash) DO UPDATE SET times_validated = eth.header_cids.times_validated + 1
+		RETURNING id`,
+		header.Number.String(), header.Hash().Hex(), header.ParentHash.Hex(), c.String(), header.Root.Hex(),
+		header.TxHash.Hex(), header.ReceiptHash.Hex(), header.UncleHash.Hex(), header.Bloom.Bytes(),
+		header.Time, mhKey).Scan(&headerID)
+	return headerID, err
+}
+
+// PublishStateNode publishes a state trie node IPLD block and indexes it in state_cids,
+// returning the new state_cids.id so that storage nodes can be linked to it
+func (p *PostgresPublisher) PublishStateNode(node *eth.StateNodeModel, headerID int64, raw []byte) (int64, error) {
+	tx, err := p.BeginTx()
+	if err != nil {
+		return 0, err
+	}
+	stateID, err := p.PublishStateNodeInTx(tx, node, headerID, raw)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return stateID, tx.Commit()
+}
+
+// PublishStateNodeInTx is PublishStateNode against a caller-supplied transaction
+func (p *PostgresPublisher) PublishStateNodeInTx(tx *sqlx.Tx, node *eth.StateNodeModel, headerID int64, raw []byte) (int64, error) {
+	c := keccak256ToCid(MEthStateTrie, crypto.Keccak256(raw))
+	mhKey := dshelp.CidToDsKey(c).String()
+	if err := publishIPLD(tx, mhKey, raw); err != nil {
+		return 0, err
+	}
+	var stateID int64
+	// ON CONFLICT is a no-op update rather than DO NOTHING so that RETURNING still yields
+	// the existing row's id: a plain DO NOTHING returns zero rows on conflict, which would
+	// surface a retried/already-published node as a hard error instead of the idempotent
+	// success the caller (and re-running a snapshot without a checkpoint file) expects
+	err := tx.QueryRowx(`INSERT INTO eth.state_cids (header_id, state_leaf_key, cid, state_path, node_type, balance,
+			nonce, code_hash, storage_root, mh_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (header_id, state_path) DO UPDATE SET state_path = eth.state_cids.state_path
+		RETURNING id`,
+		headerID, node.StateKey, c.String(), node.Path, node.NodeType, node.Balance, node.Nonce, node.CodeHash,
+		node.StorageRoot, mhKey).Scan(&stateID)
+	return stateID, err
+}
+
+// PublishStorageNode publishes a storage trie node IPLD block and indexes it in storage_cids,
+// linked to its parent state node by stateID
+func (p *PostgresPublisher) PublishStorageNode(node *eth.StorageNodeModel, stateID int64, raw []byte) error {
+	tx, err := p.BeginTx()
+	if err != nil {
+		return err
+	}
+	if err := p.PublishStorageNodeInTx(tx, node, stateID, raw); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// PublishStorageNodeInTx is PublishStorageNode against a caller-supplied transaction
+func (p *PostgresPublisher) PublishStorageNodeInTx(tx *sqlx.Tx, node *eth.StorageNodeModel, stateID int64, raw []byte) error {
+	c := keccak256ToCid(MEthStorageTrie, crypto.Keccak256(raw))
+	mhKey := dshelp.CidToDsKey(c).String()
+	if err := publishIPLD(tx, mhKey, raw); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO eth.storage_cids (state_id, storage_leaf_key, cid, storage_path, node_type, mh_key)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (state_id, storage_path) DO NOTHING`,
+		stateID, node.StorageKey, c.String(), node.Path, node.NodeType, mhKey)
+	return err
+}
+
+// PublishCode publishes a contract's runtime bytecode as a raw-eth IPLD block in
+// public.blocks, keyed by the multihash of codeHash; it adds no row to any eth.* table
+func (p *PostgresPublisher) PublishCode(codeHash []byte, code []byte) error {
+	tx, err := p.BeginTx()
+	if err != nil {
+		return err
+	}
+	if err := p.PublishCodeInTx(tx, codeHash, code); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// PublishCodeInTx is PublishCode against a caller-supplied transaction
+func (p *PostgresPublisher) PublishCodeInTx(tx *sqlx.Tx, codeHash []byte, code []byte) error {
+	c := keccak256ToCid(RawBinary, codeHash)
+	mhKey := dshelp.CidToDsKey(c).String()
+	return publishIPLD(tx, mhKey, code)
+}
+
+// SaveProgress upserts the most recently completed nodePath for (blockHash, subtreePrefix)
+// into eth.snapshot_progress, so that a crashed snapshot can be resumed close to where it
+// left off. subtreePrefix is empty for the single-threaded traversal, or the hex-encoded
+// top-level nibble path of the subtrie a worker is walking.
+func (p *PostgresPublisher) SaveProgress(blockHash common.Hash, subtreePrefix string, nodePath []byte) error {
+	_, err := p.db.Exec(`INSERT INTO eth.snapshot_progress (block_hash, subtree_prefix, node_path)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (block_hash, subtree_prefix) DO UPDATE SET node_path = $3`,
+		blockHash.Hex(), subtreePrefix, nodePath)
+	return err
+}
+
+// PublishProofNode publishes a single trie node collected as part of a Merkle proof as
+// an eth-state-trie IPLD block, without indexing it in state_cids (it has no fixed path
+// in the canonical trie traversal), and returns its CID
+func (p *PostgresPublisher) PublishProofNode(tx *sqlx.Tx, raw []byte) (string, error) {
+	c := keccak256ToCid(MEthStateTrie, crypto.Keccak256(raw))
+	mhKey := dshelp.CidToDsKey(c).String()
+	if err := publishIPLD(tx, mhKey, raw); err != nil {
+		return "", err
+	}
+	return c.String(), nil
+}
+
+// PublishAccountRange indexes a snap-protocol-style account range - a contiguous chunk of
+// leaves from the state trie, plus the CIDs of the Merkle proof nodes bounding it - in
+// eth.account_ranges, letting a consumer verify the chunk against the header state root
+// without holding the entire trie
+func (p *PostgresPublisher) PublishAccountRange(headerID int64, rng *eth.AccountRangeModel) (int64, error) {
+	var rangeID int64
+	err := p.db.QueryRowx(`INSERT INTO eth.account_ranges (header_id, first_key, last_key, keys, values, proof_cids)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`,
+		headerID, rng.FirstKey, rng.LastKey, pq.Array(rng.Keys), pq.Array(rng.Values), pq.Array(rng.ProofCIDs)).Scan(&rangeID)
+	return rangeID, err
+}
+
+// PublishStorageRange is PublishAccountRange's storage-trie counterpart, indexed in
+// eth.storage_ranges and linked to its parent account by stateID
+func (p *PostgresPublisher) PublishStorageRange(stateID int64, rng *eth.StorageRangeModel) (int64, error) {
+	var rangeID int64
+	err := p.db.QueryRowx(`INSERT INTO eth.storage_ranges (state_id, first_key, last_key, keys, values, proof_cids)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`,
+		stateID, rng.FirstKey, rng.LastKey, pq.Array(rng.Keys), pq.Array(rng.Values), pq.Array(rng.ProofCIDs)).Scan(&rangeID)
+	return rangeID, err
+}
+
+// Close is a no-op: every PostgresPublisher write already commits its own transaction,
+// so there is nothing left to flush when the publisher is done being used
+func (p *PostgresPublisher) Close() error {
+	return nil
+}
+
+// publishIPLD inserts a raw IPLD block into public.blocks, keyed by its multihash
+func publishIPLD(tx *sqlx.Tx, mhKey string, raw []byte) error {
+	_, err := tx.Exec(`INSERT INTO public.blocks (key, data) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING`, mhKey, raw)
+	return err
+}
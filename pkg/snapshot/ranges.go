@@ -0,0 +1,175 @@
+// Copyright © 2020 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/log"
+
+	"github.com/vulcanize/ipfs-blockchain-watcher/pkg/eth"
+)
+
+// defaultRangeSize is the number of leaves collected into one emitted account/storage
+// range when Config.RangeSize is unset
+const defaultRangeSize = 4096
+
+// emitAccountRanges walks the account trie in leaf order, publishing a snap-protocol-style
+// eth.AccountRangeModel (keys, values and a boundary Merkle proof) for every rangeSize leaves,
+// so that a downstream consumer can verify a chunk of the snapshot against the header state
+// root without needing the entire trie
+func (s *Service) emitAccountRanges(t state.Trie, headerID int64) error {
+	rangeSize := s.con.RangeSize
+	if rangeSize <= 0 {
+		rangeSize = defaultRangeSize
+	}
+	it := t.NodeIterator(nil)
+	var keys []string
+	var values [][]byte
+	for it.Next(true) {
+		if !it.Leaf() {
+			continue
+		}
+		keys = append(keys, common.BytesToHash(it.LeafKey()).Hex())
+		values = append(values, append([]byte{}, it.LeafBlob()...))
+		if len(keys) == rangeSize {
+			if err := s.flushAccountRange(t, headerID, keys, values); err != nil {
+				return err
+			}
+			keys, values = nil, nil
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return s.flushAccountRange(t, headerID, keys, values)
+	}
+	return nil
+}
+
+func (s *Service) flushAccountRange(t state.Trie, headerID int64, keys []string, values [][]byte) error {
+	proofCIDs, err := s.proveRange(t, keys)
+	if err != nil {
+		return err
+	}
+	rng := &eth.AccountRangeModel{
+		FirstKey:  keys[0],
+		LastKey:   keys[len(keys)-1],
+		Keys:      keys,
+		Values:    values,
+		ProofCIDs: proofCIDs,
+	}
+	if _, err := s.pgPublisher.PublishAccountRange(headerID, rng); err != nil {
+		return err
+	}
+	log.Info("published account range", "header_id", headerID, "size", len(keys), "first", rng.FirstKey, "last", rng.LastKey)
+	return nil
+}
+
+// emitStorageRanges is emitAccountRanges' storage-trie counterpart, run once per account
+// that has non-empty storage
+func (s *Service) emitStorageRanges(sr common.Hash, stateID int64) error {
+	if bytes.Equal(sr.Bytes(), emptyContractRoot.Bytes()) {
+		return nil
+	}
+	sTrie, err := s.stateDB.OpenTrie(sr)
+	if err != nil {
+		return err
+	}
+	rangeSize := s.con.RangeSize
+	if rangeSize <= 0 {
+		rangeSize = defaultRangeSize
+	}
+	it := sTrie.NodeIterator(nil)
+	var keys []string
+	var values [][]byte
+	for it.Next(true) {
+		if !it.Leaf() {
+			continue
+		}
+		keys = append(keys, common.BytesToHash(it.LeafKey()).Hex())
+		values = append(values, append([]byte{}, it.LeafBlob()...))
+		if len(keys) == rangeSize {
+			if err := s.flushStorageRange(sTrie, stateID, keys, values); err != nil {
+				return err
+			}
+			keys, values = nil, nil
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return s.flushStorageRange(sTrie, stateID, keys, values)
+	}
+	return nil
+}
+
+func (s *Service) flushStorageRange(t state.Trie, stateID int64, keys []string, values [][]byte) error {
+	proofCIDs, err := s.proveRange(t, keys)
+	if err != nil {
+		return err
+	}
+	rng := &eth.StorageRangeModel{
+		FirstKey:  keys[0],
+		LastKey:   keys[len(keys)-1],
+		Keys:      keys,
+		Values:    values,
+		ProofCIDs: proofCIDs,
+	}
+	_, err = s.pgPublisher.PublishStorageRange(stateID, rng)
+	return err
+}
+
+// proveRange calls trie.Prove on the same trie handle for the first and last key of a
+// range, collecting the resulting proof nodes into an in-memory KV store, publishing each
+// as an IPLD block and returning their CIDs
+func (s *Service) proveRange(t state.Trie, keys []string) ([]string, error) {
+	proofDB := memorydb.New()
+	first := common.HexToHash(keys[0]).Bytes()
+	last := common.HexToHash(keys[len(keys)-1]).Bytes()
+	if err := t.Prove(first, 0, proofDB); err != nil {
+		return nil, err
+	}
+	if err := t.Prove(last, 0, proofDB); err != nil {
+		return nil, err
+	}
+	tx, err := s.pgPublisher.BeginTx()
+	if err != nil {
+		return nil, err
+	}
+	var cids []string
+	iter := proofDB.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		raw := append([]byte{}, iter.Value()...)
+		c, err := s.pgPublisher.PublishProofNode(tx, raw)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		cids = append(cids, c)
+	}
+	if err := iter.Error(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return cids, tx.Commit()
+}
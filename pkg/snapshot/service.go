@@ -36,28 +36,63 @@ var (
 	nullHash          = common.HexToHash("0x0000000000000000000000000000000000000000000000000000000000000000")
 	emptyNode, _      = rlp.EncodeToBytes([]byte{})
 	emptyContractRoot = crypto.Keccak256Hash(emptyNode)
+	emptyCodeHash     = crypto.Keccak256([]byte{})
 )
 
+// progressInterval is how many state nodes are processed between persisting the
+// current nodePath to eth.snapshot_progress, so that a killed snapshot can resume
+// close to where it left off rather than from the very beginning of the trie
+const progressInterval = 1000
+
 type Service struct {
 	ethDB         ethdb.Database
 	stateDB       state.Database
-	ipfsPublisher *Publisher
+	ipfsPublisher Publisher
+	// pgPublisher is set iff ipfsPublisher is backed by Postgres. Resumable/parallel
+	// snapshotting and snap-protocol ranges rely on SQL transactions and tables that the
+	// CAR backend has no equivalent for, so those features fall back to this field
+	// directly rather than being part of the Publisher interface.
+	pgPublisher *PostgresPublisher
+	// con is retained so that a parallel snapshot can open additional state.Database
+	// views and Postgres connections, one per worker
+	con Config
 }
 
 func NewSnapshotService(con Config) (*Service, error) {
-	pgdb, err := postgres.NewDB(con.DBConfig, con.Node)
-	if err != nil {
-		return nil, err
-	}
 	edb, err := rawdb.NewLevelDBDatabase(con.LevelDBPath, 256, 0, "")
 	if err != nil {
 		return nil, err
 	}
-	return &Service{
-		ethDB:         edb,
-		stateDB:       state.NewDatabase(edb),
-		ipfsPublisher: NewPublisher(pgdb),
-	}, nil
+	svc := &Service{
+		ethDB:   edb,
+		stateDB: state.NewDatabase(edb),
+		con:     con,
+	}
+	switch con.Output {
+	case "", OutputPostgres:
+		pgdb, err := postgres.NewDB(con.DBConfig, con.Node)
+		if err != nil {
+			return nil, err
+		}
+		pgPublisher := NewPublisher(pgdb)
+		svc.ipfsPublisher = pgPublisher
+		svc.pgPublisher = pgPublisher
+	case OutputCar:
+		carPublisher, err := NewCarPublisher(con.CarPath, con.CarSidecarPath)
+		if err != nil {
+			return nil, err
+		}
+		svc.ipfsPublisher = carPublisher
+	default:
+		return nil, fmt.Errorf("unknown output backend %q", con.Output)
+	}
+	return svc, nil
+}
+
+// Close releases the resources held by the service's output backend, finalizing the
+// CAR file and sidecar when Output is OutputCar
+func (s *Service) Close() error {
+	return s.ipfsPublisher.Close()
 }
 
 func (s *Service) CreateSnapshot(height uint64, hash common.Hash) error {
@@ -68,15 +103,84 @@ func (s *Service) CreateSnapshot(height uint64, hash common.Hash) error {
 	if err != nil {
 		return err
 	}
+	if s.con.Workers > 1 {
+		if s.pgPublisher == nil {
+			return fmt.Errorf("parallel snapshotting (--workers) requires the postgres output backend")
+		}
+		if s.con.EmitRanges {
+			return fmt.Errorf("--emit-ranges is not supported together with --workers (parallel snapshotting)")
+		}
+		return s.createSnapshotParallel(header, headerID)
+	}
+	if s.con.EmitRanges && s.pgPublisher == nil {
+		return fmt.Errorf("snap-protocol ranges (--emit-ranges) require the postgres output backend")
+	}
+	t, err := s.stateDB.OpenTrie(header.Root)
+	if err != nil {
+		return err
+	}
+	trieDB := s.stateDB.TrieDB()
+	if err := s.createSnapshot(t.NodeIterator([]byte{}), trieDB, headerID, hash); err != nil {
+		return err
+	}
+	if s.con.EmitRanges {
+		return s.emitAccountRanges(t, headerID)
+	}
+	return nil
+}
+
+// CreateSnapshotInRange snapshots every block in [start, end], inclusive, so that a
+// full-archive snapshot can be chunked across machines by block range
+func (s *Service) CreateSnapshotInRange(start, end uint64) error {
+	if start > end {
+		return fmt.Errorf("range start (%d) must not be greater than range end (%d)", start, end)
+	}
+	for height := start; height <= end; height++ {
+		hash := rawdb.ReadCanonicalHash(s.ethDB, height)
+		if bytes.Equal(hash.Bytes(), nullHash.Bytes()) {
+			return fmt.Errorf("no canonical hash found for block %d", height)
+		}
+		log.Info("snapshotting block in range", "height", height, "hash", hash.Hex())
+		if err := s.CreateSnapshot(height, hash); err != nil {
+			return fmt.Errorf("snapshot of block %d (%s) failed: %v", height, hash.Hex(), err)
+		}
+	}
+	return nil
+}
+
+// ResumeSnapshot restarts a crashed or killed snapshot of the block at (height, hash),
+// seeding the state trie iterator at fromPath instead of the root so that already
+// published nodes are not revisited. fromPath is typically the nodePath most recently
+// persisted to eth.snapshot_progress for this block.
+func (s *Service) ResumeSnapshot(height uint64, hash common.Hash, fromPath []byte) error {
+	header := rawdb.ReadHeader(s.ethDB, hash, height)
+	if header == nil {
+		return fmt.Errorf("no header found for block %d (%s)", height, hash.Hex())
+	}
+	headerID, err := s.ipfsPublisher.PublishHeader(header)
+	if err != nil {
+		return err
+	}
 	t, err := s.stateDB.OpenTrie(header.Root)
 	if err != nil {
 		return err
 	}
 	trieDB := s.stateDB.TrieDB()
-	return s.createSnapshot(t.NodeIterator([]byte{}), trieDB, headerID)
+	// fromPath is a nibble path (one nibble per byte), while NodeIterator seeks by key
+	// bytes, so pack it two nibbles to a byte before seeding the iterator
+	start := make([]byte, (len(fromPath)+1)/2)
+	for i, nibble := range fromPath {
+		if i%2 == 0 {
+			start[i/2] = nibble << 4
+		} else {
+			start[i/2] |= nibble & 0x0f
+		}
+	}
+	return s.createSnapshot(t.NodeIterator(start), trieDB, headerID, hash)
 }
 
-func (s *Service) createSnapshot(it trie.NodeIterator, trieDB *trie.Database, headerID int64) error {
+func (s *Service) createSnapshot(it trie.NodeIterator, trieDB *trie.Database, headerID int64, hash common.Hash) error {
+	var processed int
 	for it.Next(true) {
 		if it.Leaf() { // "leaf" nodes are actually "value" nodes, whose parents are the actual leaves
 			continue
@@ -98,6 +202,12 @@ func (s *Service) createSnapshot(it trie.NodeIterator, trieDB *trie.Database, he
 		if err != nil {
 			return err
 		}
+		processed++
+		if processed%progressInterval == 0 && s.pgPublisher != nil {
+			if err := s.pgPublisher.SaveProgress(hash, "", nodePath); err != nil {
+				return fmt.Errorf("failed to persist snapshot progress at path %x: %v", nodePath, err)
+			}
+		}
 		switch ty {
 		case Leaf:
 			var account state.Account
@@ -108,18 +218,49 @@ func (s *Service) createSnapshot(it trie.NodeIterator, trieDB *trie.Database, he
 			valueNodePath := append(nodePath, partialPath...)
 			encodedPath := trie.HexToCompact(valueNodePath)
 			leafKey := encodedPath[1:]
-			// publish state node
-			stateNode := eth.StateNodeModel{}
+			stateNode := &eth.StateNodeModel{
+				Path:        nodePath,
+				StateKey:    common.BytesToHash(leafKey).Hex(),
+				NodeType:    int(Leaf),
+				Balance:     account.Balance.String(),
+				Nonce:       account.Nonce,
+				CodeHash:    common.BytesToHash(account.CodeHash).Hex(),
+				StorageRoot: account.Root.Hex(),
+			}
+			stateID, err := s.ipfsPublisher.PublishStateNode(stateNode, headerID, node)
+			if err != nil {
+				return fmt.Errorf("failed publishing state leaf node at path %x\r\nerror: %v", nodePath, err)
+			}
+			if !bytes.Equal(account.CodeHash, emptyCodeHash) {
+				code := rawdb.ReadCode(s.ethDB, common.BytesToHash(account.CodeHash))
+				if len(code) == 0 {
+					return fmt.Errorf("could not find code for codehash %s", common.BytesToHash(account.CodeHash).Hex())
+				}
+				if err := s.ipfsPublisher.PublishCode(account.CodeHash, code); err != nil {
+					return fmt.Errorf("failed publishing code for codehash %s\r\nerror: %v", common.BytesToHash(account.CodeHash).Hex(), err)
+				}
+			}
 			if err := s.storageSnapshot(account.Root, stateID); err != nil {
 				return fmt.Errorf("failed building eventual storage diffs for account %+v\r\nerror: %v", account, err)
 			}
+			if s.con.EmitRanges {
+				if err := s.emitStorageRanges(account.Root, stateID); err != nil {
+					return fmt.Errorf("failed emitting storage ranges for account %+v\r\nerror: %v", account, err)
+				}
+			}
 		case Extension, Branch:
-			// publish state node
-			stateNode := eth.StateNodeModel{}
+			stateNode := &eth.StateNodeModel{
+				Path:     nodePath,
+				NodeType: int(ty),
+			}
+			if _, err := s.ipfsPublisher.PublishStateNode(stateNode, headerID, node); err != nil {
+				return fmt.Errorf("failed publishing state node at path %x\r\nerror: %v", nodePath, err)
+			}
 		default:
 			return fmt.Errorf("unexpected node type %s", ty)
 		}
 	}
+	return it.Error()
 }
 
 // buildStorageNodesEventual builds the storage diff node objects for a created account
@@ -163,13 +304,25 @@ func (s *Service) storageSnapshot(sr common.Hash, stateID int64) error {
 			valueNodePath := append(nodePath, partialPath...)
 			encodedPath := trie.HexToCompact(valueNodePath)
 			leafKey := encodedPath[1:]
-			storageNode := eth.StorageNodeModel{}
-
+			storageNode := &eth.StorageNodeModel{
+				Path:       nodePath,
+				StorageKey: common.BytesToHash(leafKey).Hex(),
+				NodeType:   int(Leaf),
+			}
+			if err := s.ipfsPublisher.PublishStorageNode(storageNode, stateID, node); err != nil {
+				return fmt.Errorf("failed publishing storage leaf node at path %x\r\nerror: %v", nodePath, err)
+			}
 		case Extension, Branch:
-			storageNode := eth.StorageNodeModel{}
+			storageNode := &eth.StorageNodeModel{
+				Path:     nodePath,
+				NodeType: int(ty),
+			}
+			if err := s.ipfsPublisher.PublishStorageNode(storageNode, stateID, node); err != nil {
+				return fmt.Errorf("failed publishing storage node at path %x\r\nerror: %v", nodePath, err)
+			}
 		default:
 			return fmt.Errorf("unexpected node type %s", ty)
 		}
 	}
-	return nil
+	return it.Error()
 }
\ No newline at end of file
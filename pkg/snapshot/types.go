@@ -0,0 +1,54 @@
+// Copyright © 2020 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import "fmt"
+
+// NodeType is the type of a trie node as encoded in its RLP representation
+type NodeType int
+
+// Values match the node_type convention persisted in eth.state_cids/eth.storage_cids
+const (
+	Branch    NodeType = 0
+	Extension NodeType = 1
+	Leaf      NodeType = 2
+	Unknown   NodeType = -1
+)
+
+// CheckKeyType checks the number of elements in a decoded trie node to determine
+// which type of node it is: a branch has 17 elements, an extension or leaf has 2
+// (distinguished by the first nibble of the compact-encoded path: 0 or 1 for an
+// extension, 2 or 3 for a leaf; its low-order bit only marks an odd-length path)
+func CheckKeyType(elements []interface{}) (NodeType, error) {
+	if len(elements) > 2 {
+		return Branch, nil
+	}
+	if len(elements) < 2 {
+		return Unknown, fmt.Errorf("node cannot be less than two elements in length")
+	}
+	switch elements[0].([]byte)[0] / 16 {
+	case '\x00':
+		return Extension, nil
+	case '\x01':
+		return Extension, nil
+	case '\x02':
+		return Leaf, nil
+	case '\x03':
+		return Leaf, nil
+	default:
+		return Unknown, fmt.Errorf("unknown hex prefix")
+	}
+}
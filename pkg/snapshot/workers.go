@@ -0,0 +1,346 @@
+// Copyright © 2020 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+
+	"github.com/vulcanize/ipfs-blockchain-watcher/pkg/eth"
+	"github.com/vulcanize/ipfs-blockchain-watcher/pkg/postgres"
+)
+
+// createSnapshotParallel expands the root of the state trie into up to 16 subtries (one
+// per top-level nibble) and dispatches them across a pool of con.Workers goroutines, each
+// with its own state.Database view and its own Postgres connection. Storage trie traversals
+// each run on their own goroutine, bounded by a semaphore with con.Workers slots shared by
+// all workers, since they dominate cost for contract-heavy blocks.
+func (s *Service) createSnapshotParallel(header *types.Header, headerID int64) error {
+	t, err := s.stateDB.OpenTrie(header.Root)
+	if err != nil {
+		return err
+	}
+	root, err := s.stateDB.TrieDB().Node(t.Hash())
+	if err != nil {
+		return err
+	}
+	var elements []interface{}
+	if err := rlp.DecodeBytes(root, &elements); err != nil {
+		return err
+	}
+	ty, err := CheckKeyType(elements)
+	if err != nil {
+		return err
+	}
+	if ty != Branch {
+		// trie is too shallow to usefully split; fall back to the single-threaded path
+		return s.createSnapshot(t.NodeIterator([]byte{}), s.stateDB.TrieDB(), headerID, header.Hash())
+	}
+
+	cp, err := loadCheckpoint(s.con.CheckpointPath, header.Number.Uint64(), header.Hash())
+	if err != nil {
+		return err
+	}
+
+	storageSem := make(chan struct{}, s.con.Workers)
+	nibbles := make(chan byte)
+	errs := make(chan error, s.con.Workers)
+	var wg sync.WaitGroup
+	for i := 0; i < s.con.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workerStateDB := state.NewDatabase(s.ethDB)
+			pgdb, err := postgres.NewDB(s.con.DBConfig, s.con.Node)
+			if err != nil {
+				errs <- fmt.Errorf("worker could not open postgres connection: %v", err)
+				return
+			}
+			publisher := NewPublisher(pgdb)
+			for nibble := range nibbles {
+				prefix := fmt.Sprintf("%x", []byte{nibble})
+				if cp.isDone(prefix) {
+					log.Info("skipping already-completed subtrie", "prefix", prefix)
+					continue
+				}
+				if err := s.createSubtrie(workerStateDB, publisher, header.Root, []byte{nibble}, headerID, header.Hash(), storageSem); err != nil {
+					errs <- fmt.Errorf("subtrie %s failed: %v", prefix, err)
+					continue
+				}
+				if err := cp.markDone(prefix); err != nil {
+					errs <- fmt.Errorf("failed to checkpoint subtrie %s: %v", prefix, err)
+				}
+			}
+		}()
+	}
+	for i, child := range elements[:16] {
+		if isEmptyTrieValue(child) {
+			continue
+		}
+		nibbles <- byte(i)
+	}
+	close(nibbles)
+	wg.Wait()
+	close(errs)
+
+	var firstErr error
+	for err := range errs {
+		log.Error("snapshot worker error", "error", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// createSubtrie traverses the subtrie of the state trie rooted at stateRoot whose paths
+// share the given nibble prefix, committing every state node it visits in a single
+// transaction so that a failure partway through does not leave a half-published set of
+// state nodes behind. Each account's storage trie is walked on its own goroutine, bounded
+// by storageSem, so that storage-heavy subtries don't serialize behind the single
+// goroutine doing the state-trie traversal; those storage nodes are committed in a
+// separate transaction per account, so they stay committed if the subtrie's transaction
+// is later rolled back.
+func (s *Service) createSubtrie(stateDB state.Database, publisher *PostgresPublisher, stateRoot common.Hash, prefix []byte, headerID int64, blockHash common.Hash, storageSem chan struct{}) error {
+	t, err := stateDB.OpenTrie(stateRoot)
+	if err != nil {
+		return err
+	}
+	trieDB := stateDB.TrieDB()
+	tx, err := publisher.BeginTx()
+	if err != nil {
+		return err
+	}
+	subtreePrefix := fmt.Sprintf("%x", prefix)
+	var processed int
+	var storageWG sync.WaitGroup
+	var storageErrMu sync.Mutex
+	var storageErr error
+	it := t.NodeIterator(prefix)
+	for it.Next(true) {
+		if !bytes.HasPrefix(it.Path(), prefix) {
+			break
+		}
+		if it.Leaf() {
+			continue
+		}
+		if bytes.Equal(nullHash.Bytes(), it.Hash().Bytes()) {
+			continue
+		}
+		nodePath := make([]byte, len(it.Path()))
+		copy(nodePath, it.Path())
+		node, err := trieDB.Node(it.Hash())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		var nodeElements []interface{}
+		if err := rlp.DecodeBytes(node, &nodeElements); err != nil {
+			tx.Rollback()
+			return err
+		}
+		ty, err := CheckKeyType(nodeElements)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		processed++
+		if processed%progressInterval == 0 {
+			if err := publisher.SaveProgress(blockHash, subtreePrefix, nodePath); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed to persist snapshot progress at path %x: %v", nodePath, err)
+			}
+		}
+		switch ty {
+		case Leaf:
+			var account state.Account
+			if err := rlp.DecodeBytes(nodeElements[1].([]byte), &account); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("error decoding account for leaf node at path %x error: %v", nodePath, err)
+			}
+			partialPath := trie.CompactToHex(nodeElements[0].([]byte))
+			valueNodePath := append(nodePath, partialPath...)
+			encodedPath := trie.HexToCompact(valueNodePath)
+			leafKey := encodedPath[1:]
+			stateNode := &eth.StateNodeModel{
+				Path:        nodePath,
+				StateKey:    common.BytesToHash(leafKey).Hex(),
+				NodeType:    int(Leaf),
+				Balance:     account.Balance.String(),
+				Nonce:       account.Nonce,
+				CodeHash:    common.BytesToHash(account.CodeHash).Hex(),
+				StorageRoot: account.Root.Hex(),
+			}
+			stateID, err := publisher.PublishStateNodeInTx(tx, stateNode, headerID, node)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed publishing state leaf node at path %x error: %v", nodePath, err)
+			}
+			if !bytes.Equal(account.CodeHash, emptyCodeHash) {
+				code := rawdb.ReadCode(s.ethDB, common.BytesToHash(account.CodeHash))
+				if len(code) == 0 {
+					tx.Rollback()
+					return fmt.Errorf("could not find code for codehash %s", common.BytesToHash(account.CodeHash).Hex())
+				}
+				if err := publisher.PublishCodeInTx(tx, account.CodeHash, code); err != nil {
+					tx.Rollback()
+					return fmt.Errorf("failed publishing code for codehash %s error: %v", common.BytesToHash(account.CodeHash).Hex(), err)
+				}
+			}
+			storageWG.Add(1)
+			go func(account state.Account, stateID int64) {
+				defer storageWG.Done()
+				storageSem <- struct{}{}
+				defer func() { <-storageSem }()
+				// storageSnapshotInTx runs in its own transaction rather than the
+				// subtrie's tx: that tx is still being driven by this loop on another
+				// goroutine, and a single *sqlx.Tx is pinned to one physical connection
+				// and unsafe for concurrent use.
+				if err := s.storageSnapshotInTx(publisher, stateDB, account.Root, stateID); err != nil {
+					storageErrMu.Lock()
+					if storageErr == nil {
+						storageErr = fmt.Errorf("failed building storage nodes for account %+v error: %v", account, err)
+					}
+					storageErrMu.Unlock()
+				}
+			}(account, stateID)
+		case Extension, Branch:
+			stateNode := &eth.StateNodeModel{
+				Path:     nodePath,
+				NodeType: int(ty),
+			}
+			if _, err := publisher.PublishStateNodeInTx(tx, stateNode, headerID, node); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed publishing state node at path %x error: %v", nodePath, err)
+			}
+		default:
+			tx.Rollback()
+			return fmt.Errorf("unexpected node type %s", ty)
+		}
+	}
+	if err := it.Error(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	storageWG.Wait()
+	storageErrMu.Lock()
+	defer storageErrMu.Unlock()
+	if storageErr != nil {
+		tx.Rollback()
+		return storageErr
+	}
+	return tx.Commit()
+}
+
+// storageSnapshotInTx is storageSnapshot's transactional counterpart, used from the
+// parallel worker path. It is dispatched onto its own goroutine per account by
+// createSubtrie, bounded by storageSem, so it opens its own transaction rather than
+// sharing the subtrie's: that one is concurrently being driven by the goroutine walking
+// the state trie, and a single *sqlx.Tx is unsafe for concurrent use.
+func (s *Service) storageSnapshotInTx(publisher *PostgresPublisher, stateDB state.Database, sr common.Hash, stateID int64) error {
+	if bytes.Equal(sr[:], emptyContractRoot.Bytes()) {
+		return nil
+	}
+	sTrie, err := stateDB.OpenTrie(sr)
+	if err != nil {
+		return err
+	}
+	tx, err := publisher.BeginTx()
+	if err != nil {
+		return err
+	}
+	trieDB := stateDB.TrieDB()
+	it := sTrie.NodeIterator(make([]byte, 0))
+	for it.Next(true) {
+		if it.Leaf() {
+			continue
+		}
+		if bytes.Equal(nullHash.Bytes(), it.Hash().Bytes()) {
+			continue
+		}
+		nodePath := make([]byte, len(it.Path()))
+		copy(nodePath, it.Path())
+		node, err := trieDB.Node(it.Hash())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		var nodeElements []interface{}
+		if err := rlp.DecodeBytes(node, &nodeElements); err != nil {
+			tx.Rollback()
+			return err
+		}
+		ty, err := CheckKeyType(nodeElements)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		switch ty {
+		case Leaf:
+			partialPath := trie.CompactToHex(nodeElements[0].([]byte))
+			valueNodePath := append(nodePath, partialPath...)
+			encodedPath := trie.HexToCompact(valueNodePath)
+			leafKey := encodedPath[1:]
+			storageNode := &eth.StorageNodeModel{
+				Path:       nodePath,
+				StorageKey: common.BytesToHash(leafKey).Hex(),
+				NodeType:   int(Leaf),
+			}
+			if err := publisher.PublishStorageNodeInTx(tx, storageNode, stateID, node); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed publishing storage leaf node at path %x error: %v", nodePath, err)
+			}
+		case Extension, Branch:
+			storageNode := &eth.StorageNodeModel{
+				Path:     nodePath,
+				NodeType: int(ty),
+			}
+			if err := publisher.PublishStorageNodeInTx(tx, storageNode, stateID, node); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("failed publishing storage node at path %x error: %v", nodePath, err)
+			}
+		default:
+			tx.Rollback()
+			return fmt.Errorf("unexpected node type %s", ty)
+		}
+	}
+	if err := it.Error(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// isEmptyTrieValue reports whether a branch node's child slot is unset. Only a
+// zero-length byte string is actually empty; an embedded (non-hashed) child node decodes
+// to []interface{} rather than []byte and must not be mistaken for an empty slot, or its
+// entire subtree would silently be dropped from the snapshot.
+func isEmptyTrieValue(child interface{}) bool {
+	b, ok := child.([]byte)
+	if !ok {
+		return false
+	}
+	return len(b) == 0
+}